@@ -27,3 +27,69 @@ q="?t=dolph&n=10&p=2"
 $prog "${url}/taxi$q" > r14.txt
 q="?a=GCF_000001405.40,GCA_000002115.2"
 $prog "${url}/levels$q" > r15.txt
+q="?t=765698"
+$prog "${url}/neighbors$q" > r16.txt
+q="?t=abc"
+$prog "${url}/names$q" > r17.txt
+q="?t=99999999"
+$prog "${url}/names$q" > r18.txt
+q="?t=9606,abc,99999999&envelope=1"
+$prog "${url}/names$q" > r19.txt
+q="?t=9606&label=both"
+$prog "${url}/newick$q" > r20.txt
+q="?t=9606,9605&format=tsv"
+$prog "${url}/names$q" > r21.txt
+q="?t=9606,9605&format=csv"
+$prog "${url}/names$q" > r22.txt
+ops='[{"service": "names", "params": {"t": [9606, 9605]}}, {"service": "parent", "params": {"t": 562}}]'
+curl -s -d "$ops" "${url}/batch/" > r23.txt
+q="?t=278148,602633&format=ndjson"
+$prog "${url}/accessions$q" > r24.txt
+q="?t=9606&format=ndjson"
+$prog "${url}/subtree$q" > r25.txt
+$prog "${url}/healthz" > r26.txt
+ims="If-Modified-Since: Fri, 01 Jan 2100 00:00:00 GMT"
+curl -s -o /dev/null -w "%{http_code}\n" -H "$ims" "${url}/names/?t=9606" > r27.txt
+curl -s -H "$ims" "${url}/names/?t=99999999" > r28.txt
+q="?t=9606&pretty=0"
+$prog "${url}/children$q" > r29.txt
+q="?t=abc&pretty=0"
+$prog "${url}/names$q" > r30.txt
+q="?t=9606&limit=1&offset=1"
+$prog "${url}/subtree$q" > r31.txt
+curl -s -o /dev/null -w "%header{x-total-count}\n%header{link}\n" \
+     "${url}/subtree/$q" > r32.txt
+q="?t=9606&depth=0"
+$prog "${url}/subtree$q" > r33.txt
+q="?t=9606&stop_rank=species"
+$prog "${url}/subtree$q" > r34.txt
+q="?t=9606&depth=-1"
+$prog "${url}/subtree$q" > r35.txt
+q="?t=9606&rank=subspecies"
+$prog "${url}/children$q" > r36.txt
+q="?t=9606&rank=subspecies&genomes=1"
+$prog "${url}/descendants_at_rank$q" > r37.txt
+q="?t=278148,602633&level=complete"
+$prog "${url}/accessions$q" > r38.txt
+q="?t=278148,602633&best=1"
+$prog "${url}/accessions$q" > r39.txt
+q="?t=278148,602633&per_taxon=x"
+$prog "${url}/accessions$q" > r40.txt
+q="?t=278148&recursive=0"
+$prog "${url}/accessions$q" > r41.txt
+q="?t=278148&max_depth=1"
+$prog "${url}/accessions$q" > r42.txt
+q="?t=1&ranked=1"
+$prog "${url}/lineage$q" > r43.txt
+q="?t=9606,9605,40674"
+$prog "${url}/distance_matrix$q" > r44.txt
+q="?t=9606,9605,40674&format=phylip"
+$prog "${url}/distance_matrix$q" > r45.txt
+q="?t=9606,9605,40674&collapse=1"
+$prog "${url}/tree$q" > r46.txt
+q="?t=9606,9605,40674&collapse=1&format=newick"
+$prog "${url}/tree$q" > r47.txt
+q="?t=9606&format=nested"
+$prog "${url}/subtree$q" > r48.txt
+q="?t=9606&format=nested&ranked=1"
+$prog "${url}/subtree$q" > r49.txt
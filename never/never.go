@@ -2,7 +2,14 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/dustin/go-humanize"
@@ -10,14 +17,27 @@ import (
 	"github.com/evolbioinf/neighbors/tdb"
 	"github.com/evolbioinf/never/util"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 )
 
+type database struct {
+	*tdb.TaxonomyDB
+	users sync.WaitGroup
+}
+type dbKey struct{}
 type PageData struct {
 	Services []Service
 	Title    string
@@ -42,6 +62,23 @@ type Accessions struct {
 	Taxid int         `json:"taxid"`
 	Accs  []Accession `json:"accessions"`
 }
+type Envelope struct {
+	Results    any      `json:"results"`
+	Unresolved []int    `json:"unresolved"`
+	Invalid    []string `json:"invalid"`
+}
+type AccessionFilter struct {
+	Levels   map[string]bool
+	PerTaxon int
+	MaxDepth int
+}
+type streamWriter struct {
+	http.ResponseWriter
+	enc     *json.Encoder
+	flusher http.Flusher
+	ctx     context.Context
+	started bool
+}
 type Name struct {
 	Taxid      int    `json:"taxid"`
 	Name       string `json:"name"`
@@ -89,42 +126,211 @@ type Image struct {
 	Url         string `json:"url"`
 	Attribution string `json:"attribution"`
 }
+type Path struct {
+	Mrca  Taxon   `json:"mrca"`
+	Steps int     `json:"steps"`
+	Up    []Taxon `json:"up"`
+	Down  []Taxon `json:"down"`
+}
+type DistanceMatrix struct {
+	Taxa      []int      `json:"taxa"`
+	Distances [][]int    `json:"distances"`
+	Mrcas     [][]int    `json:"mrcas"`
+	MrcaRanks [][]string `json:"mrca_ranks"`
+}
+type TreeNode struct {
+	Taxid      int           `json:"taxid"`
+	Name       string        `json:"name"`
+	CommonName string        `json:"common_name"`
+	Rank       string        `json:"rank,omitempty"`
+	RecCounts  []GenomeCount `json:"rec_genome_counts,omitempty"`
+	Children   []*TreeNode   `json:"children,omitempty"`
+}
+type Ancestor struct {
+	Taxid      int    `json:"taxid"`
+	Name       string `json:"name"`
+	CommonName string `json:"common_name"`
+	Rank       string `json:"rank"`
+}
+type RankedLineage struct {
+	Superkingdom string `json:"superkingdom"`
+	Kingdom      string `json:"kingdom"`
+	Phylum       string `json:"phylum"`
+	Class        string `json:"class"`
+	Order        string `json:"order"`
+	Family       string `json:"family"`
+	Genus        string `json:"genus"`
+	Species      string `json:"species"`
+}
+type Lineage struct {
+	Taxid     int            `json:"taxid"`
+	Ancestors []Ancestor     `json:"lineage"`
+	Ranked    *RankedLineage `json:"ranked_lineage,omitempty"`
+}
+type Neighbors struct {
+	Mrca      int          `json:"mrca"`
+	Targets   []Accessions `json:"targets"`
+	Neighbors []Accessions `json:"neighbors"`
+}
+type Operation struct {
+	Service string         `json:"service"`
+	Params  map[string]any `json:"params"`
+}
+type BatchResult struct {
+	Service string          `json:"service"`
+	Status  int             `json:"status"`
+	Result  json.RawMessage `json:"result"`
+}
+type bufferWriter struct {
+	header http.Header
+	status int
+	wrote  bool
+	body   bytes.Buffer
+}
+type measuredWriter struct {
+	http.ResponseWriter
+	start  time.Time
+	status int
+	size   int
+}
+type counters struct {
+	sync.Mutex
+	requests  map[requestKey]int
+	durations map[string]*histogram
+	sizes     map[string]*histogram
+	inFlight  int
+}
+type requestKey struct {
+	service string
+	status  int
+}
+type histogram struct {
+	bounds []float64
+	counts []int
+	sum    float64
+	n      int
+}
+type Health struct {
+	Status string `json:"status"`
+}
+type Readiness struct {
+	Status   string `json:"status"`
+	Database string `json:"database"`
+	Updated  string `json:"updated,omitempty"`
+	NumTaxa  int    `json:"num_taxa"`
+	Error    string `json:"error,omitempty"`
+}
+type cacheEntry struct {
+	key    string
+	header http.Header
+	body   []byte
+}
+type responseCache struct {
+	sync.Mutex
+	order          *list.List
+	entries        map[string]*list.Element
+	capacity, size int
+	stamp          time.Time
+	hits, misses   int
+}
+type cacheWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+type validators struct {
+	mod time.Time
+	tag string
+}
+type validatingWriter struct {
+	http.ResponseWriter
+	v         *validators
+	r         *http.Request
+	wrote     bool
+	unchanged bool
+}
+type compressWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+type Pagination struct {
+	Limit, Offset int
+}
+type prettyWriter struct {
+	http.ResponseWriter
+	pretty bool
+}
+type record interface {
+	header() []string
+	records() [][]string
+}
 
 var host, port string
-var neidb *tdb.TaxonomyDB
+var dbFile string
+var curDB atomic.Pointer[database]
+var dbMutex sync.Mutex
 var dateFile string
 var services []Service
 var templates = template.New("templates")
 var templateFuncs = make(template.FuncMap)
+var batchServices map[string]func(http.ResponseWriter,
+	*http.Request, *PageData)
+var maxOps = 1000
+var stats = counters{
+	requests:  make(map[requestKey]int),
+	durations: make(map[string]*histogram),
+	sizes:     make(map[string]*histogram),
+}
+var durationBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1,
+	0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+var sizeBounds = []float64{1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8}
+var readyTimeout = 2 * time.Second
+var cachedHeaders = []string{"Content-Type", "X-Total-Count",
+	"Link", "Access-Control-Expose-Headers"}
+var cache = &responseCache{order: list.New(),
+	entries: make(map[string]*list.Element)}
+var minCompress = 1024
+var formats = []string{"json", "tsv", "csv"}
+var reloadMutex sync.Mutex
 
+func neidb(r *http.Request) *tdb.TaxonomyDB {
+	if d, ok := r.Context().Value(dbKey{}).(*database); ok {
+		return d.TaxonomyDB
+	}
+	return curDB.Load().TaxonomyDB
+}
+func acquireDB() *database {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	d := curDB.Load()
+	d.users.Add(1)
+	return d
+}
 func index(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
+	db := neidb(r)
 	p.Title = "Neighbors"
 	p.Services = services
 	slices.SortFunc(p.Services, func(a, b Service) int {
 		return strings.Compare(a.Name, b.Name)
 	})
-	nt, err := neidb.NumTaxa()
+	nt, err := db.NumTaxa()
 	util.Check(err)
 	p.Ntaxa = humanize.Comma(int64(nt))
 	ng := 0
 	for _, level := range tdb.AssemblyLevels() {
-		n, err := neidb.NumGenomesRec(1, level)
+		n, err := db.NumGenomesRec(1, level)
 		util.Check(err)
 		ng += n
 	}
 	p.Ngenomes = humanize.Comma(int64(ng))
-	date, err := os.ReadFile(dateFile)
+	date, err := databaseDate()
 	util.Check(err)
-	fields := strings.Fields(string(date))
-	p.Date = fmt.Sprintf("%s %s %s at %s %s %s",
-		fields[1],
-		fields[2],
-		fields[6],
-		fields[3],
-		fields[4],
-		fields[5])
-
+	p.Date = date
 	err = templates.ExecuteTemplate(w, "index", p)
 	util.Check(err)
 }
@@ -158,6 +364,14 @@ func init() {
 	service = Service{Name: "subtree",
 		Query: query}
 	services = append(services, service)
+	query = "?t=9606&label=both"
+	service = Service{Name: "newick",
+		Query: query}
+	services = append(services, service)
+	query = "?t=9605&rank=species&genomes=1"
+	service = Service{Name: "descendants_at_rank",
+		Query: query}
+	services = append(services, service)
 	query = "?t=Homo+sapiens"
 	service = Service{Name: "taxids",
 		Query: query}
@@ -187,6 +401,41 @@ func init() {
 	service = Service{Name: "path",
 		Query: query}
 	services = append(services, service)
+	query = "?t=9606,10090,9031,562"
+	service = Service{Name: "distance_matrix",
+		Query: query}
+	services = append(services, service)
+	query = "?t=9606,10090,9031,562&collapse=1"
+	service = Service{Name: "tree",
+		Query: query}
+	services = append(services, service)
+	query = "?t=9606,562&ranked=1"
+	service = Service{Name: "lineage",
+		Query: query}
+	services = append(services, service)
+	query = "?t=278148"
+	service = Service{Name: "neighbors",
+		Query: query}
+	services = append(services, service)
+}
+func databaseDate() (string, error) {
+	date, err := os.ReadFile(dateFile)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(date))
+	if len(fields) != 7 {
+		return "", fmt.Errorf("%q doesn't look like a date",
+			string(date))
+	}
+	d := fmt.Sprintf("%s %s %s at %s %s %s",
+		fields[1],
+		fields[2],
+		fields[6],
+		fields[3],
+		fields[4],
+		fields[5])
+	return d, nil
 }
 func inc(i int) int {
 	return i + 1
@@ -197,16 +446,31 @@ func init() {
 	path := "./static/templates.html"
 	templates = template.Must(templates.ParseFiles(path))
 }
-func makeHandler(fn func(http.ResponseWriter, *http.Request,
-	*PageData)) http.HandlerFunc {
+func makeHandler(name string, fn func(http.ResponseWriter,
+	*http.Request, *PageData)) http.HandlerFunc {
 	p := new(PageData)
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin",
 			"*")
-		fn(w, r, p)
+		d := acquireDB()
+		defer d.users.Done()
+		ctx := context.WithValue(r.Context(), dbKey{}, d)
+		r = r.WithContext(ctx)
+		w.Header().Add("Vary", "Accept")
+		mw := startRequest(w)
+		defer finishRequest(name, mw)
+		v := getValidators(r, name)
+		vw := &validatingWriter{ResponseWriter: mw, v: v, r: r}
+		cw := newCompressWriter(vw, r)
+		pretty, err := getPretty(r)
+		pw := &prettyWriter{ResponseWriter: cw,
+			pretty: pretty || err != nil}
+		fn(pw, r, p)
+		cw.Close()
 	}
 }
 func taxi(w http.ResponseWriter, r *http.Request, p *PageData) {
+	db := neidb(r)
 	out := []Taxon{}
 	name := ""
 	name = r.URL.Query().Get("t")
@@ -221,22 +485,38 @@ func taxi(w http.ResponseWriter, r *http.Request, p *PageData) {
 		var limit, offset int
 		limit, err := strconv.Atoi(size)
 		if err != nil {
+			if size != "" {
+				util.WriteError(w, http.StatusBadRequest,
+					"malformed page size", "n", size)
+				return
+			}
 			limit = 0
 		}
 		pageNum, err := strconv.Atoi(page)
 		if err != nil {
+			if page != "" {
+				util.WriteError(w, http.StatusBadRequest,
+					"malformed page number", "p", page)
+				return
+			}
 			pageNum = 1
 		}
 		offset = (pageNum - 1) * limit
-		ids, err := neidb.CommonTaxids(name, limit, offset)
-		util.Check(err)
+		ids, err := db.CommonTaxids(name, limit, offset)
+		if util.CheckHTTP(w, err) {
+			return
+		}
 		for _, id := range ids {
-			sciName, err := neidb.Name(id)
-			util.Check(err)
-			comName, err := neidb.CommonName(id)
-			util.Check(err)
+			sciName, err := db.Name(id)
+			if util.CheckHTTP(w, err) {
+				return
+			}
+			comName, err := db.CommonName(id)
+			if util.CheckHTTP(w, err) {
+				return
+			}
 			tout := Taxon{}
-			parent, err := neidb.Parent(id)
+			parent, err := db.Parent(id)
 			if err == nil {
 				tout = Taxon{Taxid: id, Parent: parent,
 					Name: sciName, CommonName: comName}
@@ -246,345 +526,2278 @@ func taxi(w http.ResponseWriter, r *http.Request, p *PageData) {
 			}
 		}
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	printResult(w, r, out)
 }
 func accessions(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
-	taxa := getTaxa(w, r)
+	db := neidb(r)
+	env := getEnvelope(r)
+	pg, ok := getPagination(w, r)
+	if !ok {
+		return
+	}
+	filter, ok := getAccessionFilter(w, r)
+	if !ok {
+		return
+	}
+	taxa, ok := getTaxa(w, r, env)
+	if !ok {
+		return
+	}
+	if getFormat(r) == "ndjson" {
+		if env != nil {
+			util.WriteError(w, http.StatusBadRequest,
+				"envelope not available in stream", "format", "ndjson")
+			return
+		}
+		if pg != nil {
+			util.WriteError(w, http.StatusBadRequest,
+				"pagination not available in stream", "format", "ndjson")
+			return
+		}
+		stream := newStreamWriter(w, r)
+		walkAccessions(stream, db, taxa, map[int]bool{}, filter,
+			func(a Accessions) error {
+				return stream.send(a)
+			})
+		return
+	}
+	out, ok := collectAccessions(w, db, taxa, map[int]bool{}, filter)
+	if !ok {
+		return
+	}
+	out = paginate(w, r, pg, out)
+	var res any = out
+	if env != nil {
+		env.Results = out
+		res = env
+	}
+	printResult(w, r, res)
+}
+func getTaxa(w http.ResponseWriter, r *http.Request,
+	env *Envelope) ([]int, bool) {
+	db := neidb(r)
+	taxa := []int{}
+	tokens, ok := getTokens(w, r)
+	if !ok {
+		return taxa, false
+	}
+	if len(tokens) == 0 {
+		util.WriteError(w, http.StatusBadRequest,
+			"missing taxon ID", "t", "")
+		return taxa, false
+	}
+	for _, token := range tokens {
+		taxon := 0
+		taxon, err := strconv.Atoi(strings.TrimSpace(token))
+		if err != nil && env != nil {
+			env.Invalid = append(env.Invalid, token)
+			continue
+		}
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest,
+				"malformed taxon ID", "t", token)
+			return taxa, false
+		}
+		_, err = db.Name(taxon)
+		if errors.Is(err, sql.ErrNoRows) && env != nil {
+			env.Unresolved = append(env.Unresolved, taxon)
+			continue
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			util.WriteError(w, http.StatusNotFound,
+				"unknown taxon ID", "t", token)
+			return taxa, false
+		}
+		if util.CheckHTTP(w, err) {
+			return taxa, false
+		}
+		taxa = append(taxa, taxon)
+	}
+	return taxa, true
+}
+func getTokens(w http.ResponseWriter,
+	r *http.Request) ([]string, bool) {
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<24))
+		if err != nil {
+			util.WriteError(w, http.StatusBadRequest,
+				"unreadable request body", "", "")
+			return nil, false
+		}
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 {
+			if body[0] == '[' {
+				var items []any
+				d := json.NewDecoder(bytes.NewReader(body))
+				d.UseNumber()
+				if err := d.Decode(&items); err != nil {
+					util.WriteError(w, http.StatusBadRequest,
+						"malformed JSON array", "", "")
+					return nil, false
+				}
+				tokens := []string{}
+				for _, item := range items {
+					tokens = append(tokens, fmt.Sprint(item))
+				}
+				return tokens, true
+			}
+			tokens := strings.FieldsFunc(string(body), func(c rune) bool {
+				return c == ',' || unicode.IsSpace(c)
+			})
+			return tokens, true
+		}
+	}
+	t := r.URL.Query().Get("t")
+	if t == "" {
+		return []string{}, true
+	}
+	return strings.Split(t, ","), true
+}
+func getEnvelope(r *http.Request) *Envelope {
+	if r.URL.Query().Get("envelope") != "1" {
+		return nil
+	}
+	env := &Envelope{Unresolved: []int{}, Invalid: []string{}}
+	return env
+}
+func collectAccessions(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxa []int, visited map[int]bool,
+	filter *AccessionFilter) ([]Accessions, bool) {
 	out := []Accessions{}
+	ok := walkAccessions(w, db, taxa, visited, filter,
+		func(a Accessions) error {
+			out = append(out, a)
+			return nil
+		})
+	return out, ok
+}
+func walkAccessions(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxa []int, visited map[int]bool, filter *AccessionFilter,
+	emit func(Accessions) error) bool {
+	depths := make([]int, len(taxa))
 	for len(taxa) > 0 {
-		taxid := taxa[0]
-		taxa = taxa[1:]
-		accs, err := neidb.Accessions(taxid)
-		util.Check(err)
+		taxid, depth := taxa[0], depths[0]
+		taxa, depths = taxa[1:], depths[1:]
+		if visited[taxid] {
+			continue
+		}
+		visited[taxid] = true
+		accs, err := db.Accessions(taxid)
+		if util.CheckHTTP(w, err) {
+			return false
+		}
 		if len(accs) > 0 {
 			o := Accessions{Taxid: taxid}
 			for _, acc := range accs {
-				level, err := neidb.Level(acc)
-				util.Check(err)
+				level, err := db.Level(acc)
+				if util.CheckHTTP(w, err) {
+					return false
+				}
+				if len(filter.Levels) > 0 && !filter.Levels[level] {
+					continue
+				}
 				accession := Accession{Accession: acc, Level: level}
 				o.Accs = append(o.Accs, accession)
 			}
-			out = append(out, o)
+			if filter.PerTaxon > 0 {
+				slices.SortStableFunc(o.Accs, func(a, b Accession) int {
+					return levelRank(a.Level) - levelRank(b.Level)
+				})
+				if len(o.Accs) > filter.PerTaxon {
+					o.Accs = o.Accs[:filter.PerTaxon]
+				}
+			}
+			if len(o.Accs) > 0 && emit(o) != nil {
+				return false
+			}
 		}
-		children, err := neidb.Children(taxid)
-		for _, child := range children {
-			taxa = append(taxa, child)
+		if filter.MaxDepth < 0 || depth < filter.MaxDepth {
+			children, err := db.Children(taxid)
+			if util.CheckHTTP(w, err) {
+				return false
+			}
+			for _, child := range children {
+				taxa = append(taxa, child)
+				depths = append(depths, depth+1)
+			}
 		}
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	return true
 }
-func getTaxa(w http.ResponseWriter, r *http.Request) []int {
-	taxa := []int{}
-	t := r.URL.Query().Get("t")
-	tokens := strings.Split(t, ",")
-	for _, token := range tokens {
-		taxon := 0
-		taxon, err := strconv.Atoi(token)
-		if err != nil {
-			continue
+func levelRank(level string) int {
+	levels := tdb.AssemblyLevels()
+	i := slices.Index(levels, level)
+	if i < 0 {
+		i = len(levels)
+	}
+	return i
+}
+func getAccessionFilter(w http.ResponseWriter,
+	r *http.Request) (*AccessionFilter, bool) {
+	filter := &AccessionFilter{MaxDepth: -1}
+	var ok bool
+	filter.Levels, ok = getLevels(w, r)
+	if !ok {
+		return nil, false
+	}
+	if v := r.URL.Query().Get("per_taxon"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			util.WriteError(w, http.StatusBadRequest,
+				"malformed per_taxon", "per_taxon", v)
+			return nil, false
+		}
+		filter.PerTaxon = n
+	}
+	if r.URL.Query().Get("best") == "1" {
+		filter.PerTaxon = 1
+	}
+	if v := r.URL.Query().Get("max_depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			util.WriteError(w, http.StatusBadRequest,
+				"malformed max_depth", "max_depth", v)
+			return nil, false
 		}
-		_, err = neidb.Name(taxon)
+		filter.MaxDepth = n
+	}
+	if v := r.URL.Query().Get("recursive"); v != "" {
+		recursive, err := strconv.ParseBool(v)
 		if err != nil {
-			continue
+			util.WriteError(w, http.StatusBadRequest,
+				"malformed recursive", "recursive", v)
+			return nil, false
 		}
-		taxa = append(taxa, taxon)
+		if !recursive {
+			filter.MaxDepth = 0
+		}
+	}
+	return filter, true
+}
+func newStreamWriter(w http.ResponseWriter,
+	r *http.Request) *streamWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	s := &streamWriter{ResponseWriter: w,
+		enc: json.NewEncoder(w), ctx: r.Context()}
+	s.flusher, _ = w.(http.Flusher)
+	return s
+}
+func (s *streamWriter) send(v any) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.started = true
+	if err := s.enc.Encode(v); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+func (s *streamWriter) WriteHeader(status int) {
+	if !s.started {
+		s.ResponseWriter.WriteHeader(status)
+	}
+}
+func (s *streamWriter) Write(b []byte) (int, error) {
+	if s.started {
+		return len(b), nil
 	}
-	return taxa
+	return s.ResponseWriter.Write(b)
+}
+func (s *streamWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
 }
 func names(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
-	taxa := getTaxa(w, r)
+	db := neidb(r)
+	env := getEnvelope(r)
+	taxa, ok := getTaxa(w, r, env)
+	if !ok {
+		return
+	}
 	out := []Name{}
 	for i, taxon := range taxa {
-		name, err := neidb.Name(taxon)
-		util.Check(err)
-		cname, err := neidb.CommonName(taxon)
-		util.Check(err)
+		name, err := db.Name(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		cname, err := db.CommonName(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
 		o := Name{Taxid: taxa[i], Name: name,
 			CommonName: cname}
 		out = append(out, o)
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	var res any = out
+	if env != nil {
+		env.Results = out
+		res = env
+	}
+	printResult(w, r, res)
 }
 func ranks(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
-	taxa := getTaxa(w, r)
+	db := neidb(r)
+	env := getEnvelope(r)
+	taxa, ok := getTaxa(w, r, env)
+	if !ok {
+		return
+	}
 	out := []Rank{}
 	for i, taxon := range taxa {
-		rank, err := neidb.Rank(taxon)
-		util.Check(err)
+		rank, err := db.Rank(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
 		o := Rank{Taxid: taxa[i], Rank: rank}
 
 		out = append(out, o)
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	var res any = out
+	if env != nil {
+		env.Results = out
+		res = env
+	}
+	printResult(w, r, res)
 }
 func parent(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
-	taxa := getTaxa(w, r)
-	taxid := 0
-	if len(taxa) > 0 {
-		taxid = taxa[0]
+	db := neidb(r)
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
 	}
-	parent, err := neidb.Parent(taxid)
-	out := Taxid{0}
-	if err == nil {
-		out = Taxid{parent}
+	taxid := taxa[0]
+	parent, err := db.Parent(taxid)
+	if util.CheckHTTP(w, err) {
+		return
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	out := Taxid{parent}
+	printResult(w, r, out)
 }
 func children(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
-	taxa := getTaxa(w, r)
-	taxid := 0
-	if len(taxa) > 0 {
-		taxid = taxa[0]
+	db := neidb(r)
+	pg, ok := getPagination(w, r)
+	if !ok {
+		return
 	}
-	children, err := neidb.Children(taxid)
-	util.Check(err)
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	taxid := taxa[0]
+	children, err := db.Children(taxid)
+	if util.CheckHTTP(w, err) {
+		return
+	}
+	children, ok = filterRanks(w, db, children, getRanks(r))
+	if !ok {
+		return
+	}
+	children = paginate(w, r, pg, children)
 	out := []Child{}
 	for _, child := range children {
-		name, err := neidb.Name(child)
-		util.Check(err)
-		cname, err := neidb.CommonName(child)
-		util.Check(err)
+		name, err := db.Name(child)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		cname, err := db.CommonName(child)
+		if util.CheckHTTP(w, err) {
+			return
+		}
 		o := Child{child, name, cname}
 		out = append(out, o)
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	printResult(w, r, out)
 }
-func subtree(w http.ResponseWriter, r *http.Request,
-	p *PageData) {
-	taxa := getTaxa(w, r)
-	taxid := 0
-	if len(taxa) > 0 {
-		taxid = taxa[0]
+func getRanks(r *http.Request) map[string]bool {
+	rank := r.URL.Query().Get("rank")
+	if rank == "" {
+		return nil
 	}
-	taxa, err := neidb.Subtree(taxid)
-	util.Check(err)
-	out := []Node{}
+	ranks := make(map[string]bool)
+	for _, rk := range strings.Split(rank, ",") {
+		ranks[strings.TrimSpace(rk)] = true
+	}
+	return ranks
+}
+func filterRanks(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxa []int, ranks map[string]bool) ([]int, bool) {
+	if ranks == nil {
+		return taxa, true
+	}
+	filtered := []int{}
 	for _, taxon := range taxa {
-		parent := taxon
-		parent, err := neidb.Parent(taxon)
-		util.Check(err)
-		if err != nil {
-			continue
-		}
-		name := ""
-		cname := ""
-		name, err = neidb.Name(taxon)
-		util.Check(err)
-		if err != nil {
-			continue
+		rank, err := db.Rank(taxon)
+		if util.CheckHTTP(w, err) {
+			return nil, false
 		}
-		cname, err = neidb.CommonName(taxon)
-		util.Check(err)
-		if err != nil {
-			continue
+		if ranks[rank] {
+			filtered = append(filtered, taxon)
 		}
-		o := Node{Taxid: taxon, Parent: parent, Name: name,
-			CommonName: cname}
-		out = append(out, o)
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	return filtered, true
 }
-func taxids(w http.ResponseWriter, r *http.Request,
+func subtree(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
-	out := []Taxid{}
-	name := r.URL.Query().Get("t")
-	if name != "" {
-		taxids, err := neidb.CommonTaxids(name, -1, 0)
-		util.Check(err)
-		for _, taxid := range taxids {
-			o := Taxid{taxid}
-			out = append(out, o)
-		}
+	db := neidb(r)
+	format := getFormat(r)
+	if format != "newick" && format != "nested" &&
+		format != "ndjson" && !slices.Contains(formats, format) {
+		util.WriteError(w, http.StatusBadRequest,
+			"unknown format", "format", format)
+		return
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
-}
-func mrca(w http.ResponseWriter, r *http.Request, p *PageData) {
-	taxa := getTaxa(w, r)
-	out := Taxid{0}
-	if len(taxa) > 0 {
-		mrca, err := neidb.MRCA(taxa)
-		if err == nil {
-			out = Taxid{mrca}
-		}
+	pg, ok := getPagination(w, r)
+	if !ok {
+		return
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
-}
-func levels(w http.ResponseWriter, r *http.Request,
-	p *PageData) {
-	str := r.URL.Query().Get("a")
-	accessions := strings.Split(str, ",")
-	out := []Level{}
-	for _, accession := range accessions {
-		level, err := neidb.Level(accession)
-		if err == nil {
-			o := Level{Accession: accession, Level: level}
-			out = append(out, o)
-		}
+	whole := format == "newick" || format == "nested"
+	if pg != nil && whole {
+		util.WriteError(w, http.StatusBadRequest,
+			"pagination not available for "+format, "format", format)
+		return
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
-}
-func num_genomes(w http.ResponseWriter, r *http.Request,
-	p *PageData) {
-	taxa := getTaxa(w, r)
-	taxid := 0
-	if len(taxa) > 0 {
-		taxid = taxa[0]
+	if pg != nil && format == "ndjson" {
+		util.WriteError(w, http.StatusBadRequest,
+			"pagination not available in stream", "format", "ndjson")
+		return
 	}
-	out := []GenomeCount{}
-	for _, level := range tdb.AssemblyLevels() {
-		n, err := neidb.NumGenomes(taxid, level)
-		if err == nil {
-			o := GenomeCount{Count: n, Level: level}
-			out = append(out, o)
-		}
+	ranks := getRanks(r)
+	if ranks != nil && whole {
+		util.WriteError(w, http.StatusBadRequest,
+			"rank filter not available for "+format, "format", format)
+		return
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
-}
-func num_genomes_rec(w http.ResponseWriter, r *http.Request,
-	p *PageData) {
-	taxa := getTaxa(w, r)
-	taxid := 0
-	if len(taxa) > 0 {
-		taxid = taxa[0]
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
 	}
-	out := []GenomeCount{}
-	for _, level := range tdb.AssemblyLevels() {
-		n, err := neidb.NumGenomesRec(taxid, level)
-		if err == nil {
-			o := GenomeCount{Count: n, Level: level}
-			out = append(out, o)
+	taxid := taxa[0]
+	var err error
+	depth := -1
+	if d := r.URL.Query().Get("depth"); d != "" {
+		depth, err = strconv.Atoi(d)
+		if err != nil || depth < 0 {
+			util.WriteError(w, http.StatusBadRequest,
+				"malformed depth", "depth", d)
+			return
 		}
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	stop := r.URL.Query().Get("stop_rank")
+	if format == "ndjson" {
+		stream := newStreamWriter(w, r)
+		walkSubtree(stream, db, taxid, depth, stop, func(taxon int) bool {
+			kept, ok := filterRanks(stream, db, []int{taxon}, ranks)
+			if !ok || len(kept) == 0 {
+				return ok
+			}
+			o, ok := newNode(stream, db, taxon)
+			if !ok || o == nil {
+				return ok
+			}
+			return stream.send(o) == nil
+		})
+		return
+	}
+	if depth < 0 && stop == "" {
+		taxa, err = db.Subtree(taxid)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+	} else {
+		taxa = []int{}
+		ok = walkSubtree(w, db, taxid, depth, stop,
+			func(taxon int) bool {
+				taxa = append(taxa, taxon)
+				return true
+			})
+		if !ok {
+			return
+		}
+	}
+	taxa, ok = filterRanks(w, db, taxa, ranks)
+	if !ok {
+		return
+	}
+	taxa = paginate(w, r, pg, taxa)
+	out := []Node{}
+	for _, taxon := range taxa {
+		o, ok := newNode(w, db, taxon)
+		if !ok {
+			return
+		}
+		if o != nil {
+			out = append(out, *o)
+		}
+	}
+	if format == "newick" {
+		printNewick(w, r, taxid, out)
+		return
+	}
+	if format == "nested" {
+		printNested(w, r, taxid, out)
+		return
+	}
+	printResult(w, r, out)
+}
+func walkSubtree(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	root, depth int, stop string, visit func(int) bool) bool {
+	if !visit(root) {
+		return false
+	}
+	level := []int{root}
+	for d := 0; len(level) > 0 && (depth < 0 || d < depth); d++ {
+		next := []int{}
+		for _, v := range level {
+			if stop != "" {
+				rank, err := db.Rank(v)
+				if util.CheckHTTP(w, err) {
+					return false
+				}
+				if rank == stop {
+					continue
+				}
+			}
+			children, err := db.Children(v)
+			if util.CheckHTTP(w, err) {
+				return false
+			}
+			for _, child := range children {
+				if !visit(child) {
+					return false
+				}
+			}
+			next = append(next, children...)
+		}
+		level = next
+	}
+	return true
+}
+func newNode(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxon int) (*Node, bool) {
+	parent, err := db.Parent(taxon)
+	if util.CheckHTTP(w, err) {
+		return nil, false
+	}
+	if err != nil {
+		return nil, true
+	}
+	name, err := db.Name(taxon)
+	if util.CheckHTTP(w, err) {
+		return nil, false
+	}
+	if err != nil {
+		return nil, true
+	}
+	cname, err := db.CommonName(taxon)
+	if util.CheckHTTP(w, err) {
+		return nil, false
+	}
+	if err != nil {
+		return nil, true
+	}
+	o := &Node{Taxid: taxon, Parent: parent, Name: name,
+		CommonName: cname}
+	return o, true
+}
+func printNewick(w http.ResponseWriter, r *http.Request,
+	root int, nodes []Node) {
+	db := neidb(r)
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = "taxid"
+	}
+	if label != "taxid" && label != "name" && label != "both" {
+		util.WriteError(w, http.StatusBadRequest,
+			"unknown label", "label", label)
+		return
+	}
+	withCounts := r.URL.Query().Get("counts") == "1"
+	children := make(map[int][]int)
+	labels := make(map[int]string)
+	notes := make(map[int]string)
+	for _, node := range nodes {
+		if node.Taxid != root {
+			children[node.Parent] = append(children[node.Parent],
+				node.Taxid)
+		}
+		labels[node.Taxid] = newickLabel(node, label)
+		if withCounts {
+			note, ok := newickNote(w, db, node.Taxid)
+			if !ok {
+				return
+			}
+			notes[node.Taxid] = note
+		}
+	}
+	var sb strings.Builder
+	writeNewick(&sb, root, children, labels, notes)
+	sb.WriteString(";")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s\n", sb.String())
+}
+func newickLabel(node Node, label string) string {
+	l := strconv.Itoa(node.Taxid)
+	if label == "name" {
+		l = node.Name
+	} else if label == "both" {
+		l = l + " " + node.Name
+	}
+	if strings.ContainsAny(l, " ()[]':;,") {
+		l = "'" + strings.ReplaceAll(l, "'", "''") + "'"
+	}
+	return l
+}
+func newickNote(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxid int) (string, bool) {
+	note := "[&&NHX"
+	for _, level := range tdb.AssemblyLevels() {
+		n, err := db.NumGenomesRec(taxid, level)
+		if util.CheckHTTP(w, err) {
+			return "", false
+		}
+		key := strings.ReplaceAll(level, " ", "_")
+		note += fmt.Sprintf(":%s=%d", key, n)
+	}
+	note += "]"
+	return note, true
+}
+func writeNewick(sb *strings.Builder, v int,
+	children map[int][]int, labels, notes map[int]string) {
+	if len(children[v]) > 0 {
+		sb.WriteString("(")
+		for i, child := range children[v] {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			writeNewick(sb, child, children, labels, notes)
+		}
+		sb.WriteString(")")
+	}
+	sb.WriteString(labels[v])
+	sb.WriteString(notes[v])
+}
+func printNested(w http.ResponseWriter, r *http.Request,
+	root int, nodes []Node) {
+	db := neidb(r)
+	ranks := make(map[int]string)
+	if r.URL.Query().Get("ranked") == "1" {
+		for _, node := range nodes {
+			rank, err := db.Rank(node.Taxid)
+			if util.CheckHTTP(w, err) {
+				return
+			}
+			ranks[node.Taxid] = rank
+		}
+	}
+	out := nestTree(root, nodes, ranks)
+	if r.URL.Query().Get("counts") == "1" {
+		if !countGenomes(w, db, out) {
+			return
+		}
+	}
+	printJSON(w, r, http.StatusOK, out)
+}
+func countGenomes(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	tn *TreeNode) bool {
+	for _, level := range tdb.AssemblyLevels() {
+		count, err := db.NumGenomesRec(tn.Taxid, level)
+		if util.CheckHTTP(w, err) {
+			return false
+		}
+		gc := GenomeCount{Count: count, Level: level}
+		tn.RecCounts = append(tn.RecCounts, gc)
+	}
+	for _, child := range tn.Children {
+		if !countGenomes(w, db, child) {
+			return false
+		}
+	}
+	return true
+}
+func newick(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	q := r.URL.Query()
+	q.Set("format", "newick")
+	r.URL.RawQuery = q.Encode()
+	subtree(w, r, p)
+}
+func descendants_at_rank(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	pg, ok := getPagination(w, r)
+	if !ok {
+		return
+	}
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	taxid := taxa[0]
+	ranks := getRanks(r)
+	if ranks == nil {
+		util.WriteError(w, http.StatusBadRequest,
+			"missing rank", "rank", "")
+		return
+	}
+	taxa, err := db.Subtree(taxid)
+	if util.CheckHTTP(w, err) {
+		return
+	}
+	taxa = slices.DeleteFunc(taxa, func(t int) bool {
+		return t == taxid
+	})
+	taxa, ok = filterRanks(w, db, taxa, ranks)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("genomes") == "1" {
+		taxa, ok = filterGenomes(w, db, taxa)
+		if !ok {
+			return
+		}
+	}
+	taxa = paginate(w, r, pg, taxa)
+	out := []Name{}
+	for i, taxon := range taxa {
+		name, err := db.Name(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		cname, err := db.CommonName(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		o := Name{Taxid: taxa[i], Name: name,
+			CommonName: cname}
+		out = append(out, o)
+	}
+	printResult(w, r, out)
+}
+func filterGenomes(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxa []int) ([]int, bool) {
+	filtered := []int{}
+	for _, taxon := range taxa {
+		for _, level := range tdb.AssemblyLevels() {
+			n, err := db.NumGenomesRec(taxon, level)
+			if util.CheckHTTP(w, err) {
+				return nil, false
+			}
+			if n > 0 {
+				filtered = append(filtered, taxon)
+				break
+			}
+		}
+	}
+	return filtered, true
+}
+func taxids(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	pg, ok := getPagination(w, r)
+	if !ok {
+		return
+	}
+	out := []Taxid{}
+	name := r.URL.Query().Get("t")
+	if name != "" {
+		taxids, err := db.CommonTaxids(name, -1, 0)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		for _, taxid := range taxids {
+			o := Taxid{taxid}
+			out = append(out, o)
+		}
+	}
+	out = paginate(w, r, pg, out)
+	printResult(w, r, out)
+}
+func mrca(w http.ResponseWriter, r *http.Request, p *PageData) {
+	db := neidb(r)
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	mrca, err := db.MRCA(taxa)
+	if util.CheckHTTP(w, err) {
+		return
+	}
+	out := Taxid{mrca}
+	printResult(w, r, out)
+}
+func levels(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	str := r.URL.Query().Get("a")
+	if str == "" {
+		util.WriteError(w, http.StatusBadRequest,
+			"missing accession", "a", str)
+		return
+	}
+	accessions := strings.Split(str, ",")
+	out := []Level{}
+	for _, accession := range accessions {
+		level, err := db.Level(accession)
+		if errors.Is(err, sql.ErrNoRows) {
+			util.WriteError(w, http.StatusNotFound,
+				"unknown accession", "a", accession)
+			return
+		}
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		o := Level{Accession: accession, Level: level}
+		out = append(out, o)
+	}
+	printResult(w, r, out)
+}
+func num_genomes(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	taxid := taxa[0]
+	out := []GenomeCount{}
+	for _, level := range tdb.AssemblyLevels() {
+		n, err := db.NumGenomes(taxid, level)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		o := GenomeCount{Count: n, Level: level}
+		out = append(out, o)
+	}
+	printResult(w, r, out)
+}
+func num_genomes_rec(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	taxid := taxa[0]
+	out := []GenomeCount{}
+	for _, level := range tdb.AssemblyLevels() {
+		n, err := db.NumGenomesRec(taxid, level)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		o := GenomeCount{Count: n, Level: level}
+		out = append(out, o)
+	}
+	printResult(w, r, out)
 }
 func taxa_info(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
-	taxa := getTaxa(w, r)
+	db := neidb(r)
+	env := getEnvelope(r)
+	taxa, ok := getTaxa(w, r, env)
+	if !ok {
+		return
+	}
 	out := []TaxonInfo{}
 	for _, taxon := range taxa {
-		parent, err := neidb.Parent(taxon)
-		util.Check(err)
-		isLeaf, err := neidb.IsLeaf(taxon)
-		util.Check(err)
-		name, err := neidb.Name(taxon)
-		util.Check(err)
-		cname, err := neidb.CommonName(taxon)
-		util.Check(err)
-		rank, err := neidb.Rank(taxon)
-		util.Check(err)
+		parent, err := db.Parent(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		isLeaf, err := db.IsLeaf(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		name, err := db.Name(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		cname, err := db.CommonName(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		rank, err := db.Rank(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
 		var raw, rec []GenomeCount
 		for _, level := range tdb.AssemblyLevels() {
-			count, err := neidb.NumGenomes(taxon, level)
-			util.Check(err)
+			count, err := db.NumGenomes(taxon, level)
+			if util.CheckHTTP(w, err) {
+				return
+			}
 			gc := GenomeCount{Count: count, Level: level}
 			raw = append(raw, gc)
-			count, err = neidb.NumGenomesRec(taxon, level)
-			util.Check(err)
+			count, err = db.NumGenomesRec(taxon, level)
+			if util.CheckHTTP(w, err) {
+				return
+			}
 			gc = GenomeCount{Count: count, Level: level}
 			rec = append(rec, gc)
 		}
-		var neiImages []Image
-		images, err := neidb.Images(taxon)
-		util.Check(err)
-		for _, image := range images {
-			i := Image{Id: image.Id,
-				Url:         image.Url,
-				Attribution: image.Attribution}
-			neiImages = append(neiImages, i)
+		var neiImages []Image
+		images, err := db.Images(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		for _, image := range images {
+			i := Image{Id: image.Id,
+				Url:         image.Url,
+				Attribution: image.Attribution}
+			neiImages = append(neiImages, i)
+		}
+		o := TaxonInfo{
+			Taxid:      taxon,
+			Parent:     parent,
+			IsLeaf:     isLeaf,
+			Name:       name,
+			CommonName: cname,
+			Rank:       rank,
+			RawCounts:  raw,
+			RecCounts:  rec,
+			Images:     neiImages}
+		out = append(out, o)
+	}
+	var res any = out
+	if env != nil {
+		env.Results = out
+		res = env
+	}
+	printResult(w, r, res)
+}
+func path(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	if len(taxa) != 2 {
+		util.WriteError(w, http.StatusBadRequest,
+			"expecting two taxon IDs", "t",
+			r.URL.Query().Get("t"))
+		return
+	}
+	start := taxa[0]
+	end := taxa[1]
+	mrca, err := db.MRCA([]int{start, end})
+	if util.CheckHTTP(w, err) {
+		return
+	}
+	out := Path{}
+	out.Mrca, ok = lookupTaxon(w, db, mrca)
+	if !ok {
+		return
+	}
+	out.Up, ok = climb(w, db, start, mrca)
+	if !ok {
+		return
+	}
+	out.Down, ok = climb(w, db, end, mrca)
+	if !ok {
+		return
+	}
+	slices.Reverse(out.Down)
+	out.Steps = len(out.Up) + len(out.Down)
+	printResult(w, r, out)
+}
+func climb(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxon, ancestor int) ([]Taxon, bool) {
+	leg := []Taxon{}
+	for taxon != ancestor {
+		t, ok := lookupTaxon(w, db, taxon)
+		if !ok {
+			return nil, false
+		}
+		leg = append(leg, t)
+		if t.Parent == taxon {
+			break
+		}
+		taxon = t.Parent
+	}
+	return leg, true
+}
+func lookupTaxon(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxon int) (Taxon, bool) {
+	t := Taxon{Taxid: taxon}
+	var err error
+	t.Parent, err = db.Parent(taxon)
+	if util.CheckHTTP(w, err) {
+		return t, false
+	}
+	t.Name, err = db.Name(taxon)
+	if util.CheckHTTP(w, err) {
+		return t, false
+	}
+	t.CommonName, err = db.CommonName(taxon)
+	if util.CheckHTTP(w, err) {
+		return t, false
+	}
+	return t, true
+}
+func distance_matrix(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	format := getFormat(r)
+	if format != "phylip" && !slices.Contains(formats, format) {
+		util.WriteError(w, http.StatusBadRequest,
+			"unknown format", "format", format)
+		return
+	}
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	steps := make([]map[int]int, len(taxa))
+	for i, taxon := range taxa {
+		steps[i], ok = ancestorSteps(w, db, taxon)
+		if !ok {
+			return
+		}
+	}
+	n := len(taxa)
+	out := DistanceMatrix{Taxa: taxa}
+	out.Distances = make([][]int, n)
+	out.Mrcas = make([][]int, n)
+	out.MrcaRanks = make([][]string, n)
+	for i := range taxa {
+		out.Distances[i] = make([]int, n)
+		out.Mrcas[i] = make([]int, n)
+		out.MrcaRanks[i] = make([]string, n)
+	}
+	ranks := make(map[int]string)
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			mrca, err := db.MRCA([]int{taxa[i], taxa[j]})
+			if util.CheckHTTP(w, err) {
+				return
+			}
+			rank, seen := ranks[mrca]
+			if !seen {
+				rank, err = db.Rank(mrca)
+				if util.CheckHTTP(w, err) {
+					return
+				}
+				ranks[mrca] = rank
+			}
+			d := steps[i][mrca] + steps[j][mrca]
+			out.Distances[i][j], out.Distances[j][i] = d, d
+			out.Mrcas[i][j], out.Mrcas[j][i] = mrca, mrca
+			out.MrcaRanks[i][j], out.MrcaRanks[j][i] = rank, rank
+		}
+	}
+	if format == "phylip" {
+		printPhylip(w, out)
+		return
+	}
+	printResult(w, r, out)
+}
+func ancestorSteps(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxon int) (map[int]int, bool) {
+	steps := make(map[int]int)
+	for n := 0; ; n++ {
+		steps[taxon] = n
+		parent, err := db.Parent(taxon)
+		if util.CheckHTTP(w, err) {
+			return nil, false
+		}
+		if parent == taxon {
+			break
+		}
+		taxon = parent
+	}
+	return steps, true
+}
+func printPhylip(w http.ResponseWriter, m DistanceMatrix) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%5d\n", len(m.Taxa))
+	for i, taxon := range m.Taxa {
+		fmt.Fprintf(w, "%-10d", taxon)
+		for _, d := range m.Distances[i] {
+			fmt.Fprintf(w, " %d", d)
+		}
+		fmt.Fprintln(w)
+	}
+}
+func tree(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "newick" {
+		util.WriteError(w, http.StatusBadRequest,
+			"unknown format", "format", format)
+		return
+	}
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	root, err := db.MRCA(taxa)
+	if util.CheckHTTP(w, err) {
+		return
+	}
+	parents := map[int]int{root: root}
+	for _, taxon := range taxa {
+		for {
+			if _, ok := parents[taxon]; ok {
+				break
+			}
+			parent, err := db.Parent(taxon)
+			if util.CheckHTTP(w, err) {
+				return
+			}
+			parents[taxon] = parent
+			if parent == taxon {
+				break
+			}
+			taxon = parent
+		}
+	}
+	if r.URL.Query().Get("collapse") == "1" {
+		collapseUnary(parents, root, taxa)
+	}
+	ids := []int{}
+	for v := range parents {
+		ids = append(ids, v)
+	}
+	slices.Sort(ids)
+	nodes := []Node{}
+	ranks := make(map[int]string)
+	for _, taxon := range ids {
+		name, err := db.Name(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		cname, err := db.CommonName(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		ranks[taxon], err = db.Rank(taxon)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+		n := Node{Taxid: taxon, Parent: parents[taxon], Name: name,
+			CommonName: cname}
+		nodes = append(nodes, n)
+	}
+	if format == "newick" {
+		printNewick(w, r, root, nodes)
+		return
+	}
+	out := nestTree(root, nodes, ranks)
+	printJSON(w, r, http.StatusOK, out)
+}
+func collapseUnary(parents map[int]int, root int, taxa []int) {
+	numChildren := make(map[int]int)
+	for v, p := range parents {
+		if v != root {
+			numChildren[p]++
+		}
+	}
+	removed := make(map[int]bool)
+	for v := range parents {
+		if v != root && numChildren[v] == 1 &&
+			!slices.Contains(taxa, v) {
+			removed[v] = true
+		}
+	}
+	for v, p := range parents {
+		if removed[v] {
+			continue
+		}
+		for removed[p] {
+			p = parents[p]
+		}
+		parents[v] = p
+	}
+	for v := range removed {
+		delete(parents, v)
+	}
+}
+func nestTree(root int, nodes []Node,
+	ranks map[int]string) *TreeNode {
+	tns := make(map[int]*TreeNode)
+	for _, n := range nodes {
+		tns[n.Taxid] = &TreeNode{Taxid: n.Taxid, Name: n.Name,
+			CommonName: n.CommonName, Rank: ranks[n.Taxid]}
+	}
+	for _, n := range nodes {
+		parent := tns[n.Parent]
+		if n.Taxid != root && parent != nil {
+			parent.Children = append(parent.Children, tns[n.Taxid])
+		}
+	}
+	return tns[root]
+}
+func lineage(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	env := getEnvelope(r)
+	taxa, ok := getTaxa(w, r, env)
+	if !ok {
+		return
+	}
+	ranked := r.URL.Query().Get("ranked") == "1"
+	out := []Lineage{}
+	for _, taxon := range taxa {
+		l, ok := climbLineage(w, db, taxon)
+		if !ok {
+			return
+		}
+		if ranked {
+			l.Ranked = rankLineage(l.Ancestors)
+		}
+		out = append(out, l)
+	}
+	var res any = out
+	if env != nil {
+		env.Results = out
+		res = env
+	}
+	printResult(w, r, res)
+}
+func climbLineage(w http.ResponseWriter, db *tdb.TaxonomyDB,
+	taxon int) (Lineage, bool) {
+	l := Lineage{Taxid: taxon}
+	for {
+		name, err := db.Name(taxon)
+		if util.CheckHTTP(w, err) {
+			return l, false
+		}
+		cname, err := db.CommonName(taxon)
+		if util.CheckHTTP(w, err) {
+			return l, false
+		}
+		rank, err := db.Rank(taxon)
+		if util.CheckHTTP(w, err) {
+			return l, false
+		}
+		a := Ancestor{Taxid: taxon, Name: name, CommonName: cname,
+			Rank: rank}
+		l.Ancestors = append(l.Ancestors, a)
+		parent, err := db.Parent(taxon)
+		if util.CheckHTTP(w, err) {
+			return l, false
+		}
+		if err != nil || parent == taxon {
+			break
+		}
+		taxon = parent
+	}
+	return l, true
+}
+func rankLineage(ancestors []Ancestor) *RankedLineage {
+	rl := new(RankedLineage)
+	fields := map[string]*string{
+		"superkingdom": &rl.Superkingdom,
+		"domain":       &rl.Superkingdom,
+		"kingdom":      &rl.Kingdom,
+		"phylum":       &rl.Phylum,
+		"class":        &rl.Class,
+		"order":        &rl.Order,
+		"family":       &rl.Family,
+		"genus":        &rl.Genus,
+		"species":      &rl.Species,
+	}
+	for _, a := range ancestors {
+		if f, ok := fields[a.Rank]; ok && *f == "" {
+			*f = a.Name
+		}
+	}
+	return rl
+}
+func neighbors(w http.ResponseWriter, r *http.Request,
+	p *PageData) {
+	db := neidb(r)
+	taxa, ok := getTaxa(w, r, nil)
+	if !ok {
+		return
+	}
+	levels, ok := getLevels(w, r)
+	if !ok {
+		return
+	}
+	out := Neighbors{}
+	mrca, err := db.MRCA(taxa)
+	if util.CheckHTTP(w, err) {
+		return
+	}
+	if slices.Contains(taxa, mrca) {
+		mrca, err = db.Parent(mrca)
+		if util.CheckHTTP(w, err) {
+			return
+		}
+	}
+	out.Mrca = mrca
+	visited := make(map[int]bool)
+	filter := &AccessionFilter{Levels: levels, MaxDepth: -1}
+	out.Targets, ok = collectAccessions(w, db, taxa, visited, filter)
+	if !ok {
+		return
+	}
+	out.Neighbors, ok = collectAccessions(w, db, []int{mrca}, visited,
+		filter)
+	if !ok {
+		return
+	}
+	printResult(w, r, out)
+}
+func getLevels(w http.ResponseWriter,
+	r *http.Request) (map[string]bool, bool) {
+	levels := make(map[string]bool)
+	for _, l := range r.URL.Query()["level"] {
+		if l == "" {
+			continue
+		}
+		for _, level := range strings.Split(l, ",") {
+			if !slices.Contains(tdb.AssemblyLevels(), level) {
+				util.WriteError(w, http.StatusBadRequest,
+					"unknown assembly level", "level", level)
+				return levels, false
+			}
+			levels[level] = true
 		}
-		o := TaxonInfo{
-			Taxid:      taxon,
-			Parent:     parent,
-			IsLeaf:     isLeaf,
-			Name:       name,
-			CommonName: cname,
-			Rank:       rank,
-			RawCounts:  raw,
-			RecCounts:  rec,
-			Images:     neiImages}
-		out = append(out, o)
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
-	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+	return levels, true
 }
-func path(w http.ResponseWriter, r *http.Request,
+func init() {
+	batchServices = map[string]func(http.ResponseWriter,
+		*http.Request, *PageData){
+		"taxi":                taxi,
+		"accessions":          accessions,
+		"names":               names,
+		"ranks":               ranks,
+		"parent":              parent,
+		"children":            children,
+		"subtree":             subtree,
+		"descendants_at_rank": descendants_at_rank,
+		"taxids":              taxids,
+		"mrca":                mrca,
+		"levels":              levels,
+		"num_genomes":         num_genomes,
+		"num_genomes_rec":     num_genomes_rec,
+		"taxa_info":           taxa_info,
+		"path":                path,
+		"neighbors":           neighbors,
+		"lineage":             lineage,
+		"distance_matrix":     distance_matrix,
+		"tree":                tree,
+	}
+}
+func batch(w http.ResponseWriter, r *http.Request,
 	p *PageData) {
-	taxa := getTaxa(w, r)
-	out := []Taxon{}
-	if len(taxa) != 2 {
-		b, err := json.MarshalIndent(out, "", "    ")
-		util.Check(err)
-		fmt.Fprintf(w, "%s\n", string(b))
+	if r.Method != http.MethodPost {
+		util.WriteError(w, http.StatusMethodNotAllowed,
+			"operations must be posted", "", "")
 		return
 	}
-	start := taxa[0]
-	end := taxa[1]
-	parent, err := neidb.Parent(start)
-	util.Check(err)
-	if parent == start && start != end {
-		b, err := json.MarshalIndent(out, "", "    ")
-		util.Check(err)
-		fmt.Fprintf(w, "%s\n", string(b))
+	var ops []Operation
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<24))
+	d.UseNumber()
+	if err := d.Decode(&ops); err != nil {
+		util.WriteError(w, http.StatusBadRequest,
+			"malformed operations", "", "")
 		return
 	}
-	name, err := neidb.Name(start)
-	util.Check(err)
-	cn, err := neidb.CommonName(start)
-	util.Check(err)
-	o := Taxon{Taxid: start, Parent: parent,
-		Name: name, CommonName: cn}
-	out = append(out, o)
-	for start != end {
-		parent, err := neidb.Parent(start)
-		util.Check(err)
-		if start == parent {
-			out = out[:0]
-			break
+	if len(ops) > maxOps {
+		util.WriteError(w, http.StatusRequestEntityTooLarge,
+			"too many operations", "",
+			strconv.Itoa(len(ops)))
+		return
+	}
+	out := []BatchResult{}
+	for _, op := range ops {
+		bw := newBufferWriter()
+		fn, ok := batchServices[op.Service]
+		if ok {
+			q := url.Values{}
+			for key, value := range op.Params {
+				if list, ok := value.([]any); ok {
+					items := []string{}
+					for _, item := range list {
+						items = append(items, fmt.Sprint(item))
+					}
+					q.Set(key, strings.Join(items, ","))
+				} else {
+					q.Set(key, fmt.Sprint(value))
+				}
+			}
+			q.Set("format", "json")
+			u := "/" + op.Service + "/?" + q.Encode()
+			req, err := http.NewRequestWithContext(r.Context(), "GET", u, nil)
+			if util.CheckHTTP(w, err) {
+				return
+			}
+			fn(bw, req, p)
+		} else {
+			util.WriteError(bw, http.StatusNotFound,
+				"unknown service", "service", op.Service)
 		}
-		start = parent
-		name, err := neidb.Name(start)
-		util.Check(err)
-		cname, err := neidb.CommonName(start)
-		util.Check(err)
-		parent, err = neidb.Parent(start)
-		util.Check(err)
-		o := Taxon{Taxid: start, Parent: parent, Name: name,
-			CommonName: cname}
+		o := BatchResult{Service: op.Service, Status: bw.status,
+			Result: bytes.TrimSpace(bw.body.Bytes())}
 		out = append(out, o)
 	}
-	b, err := json.MarshalIndent(out, "", "    ")
+	printResult(w, r, out)
+}
+func newBufferWriter() *bufferWriter {
+	return &bufferWriter{header: http.Header{},
+		status: http.StatusOK}
+}
+func (b *bufferWriter) Header() http.Header {
+	return b.header
+}
+func (b *bufferWriter) WriteHeader(status int) {
+	if !b.wrote {
+		b.status = status
+		b.wrote = true
+	}
+}
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	b.wrote = true
+	return b.body.Write(p)
+}
+func (m *measuredWriter) WriteHeader(status int) {
+	m.status = status
+	m.ResponseWriter.WriteHeader(status)
+}
+func (m *measuredWriter) Write(b []byte) (int, error) {
+	n, err := m.ResponseWriter.Write(b)
+	m.size += n
+	return n, err
+}
+func (m *measuredWriter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.n++
+}
+func newHistogram(bounds []float64) *histogram {
+	h := &histogram{bounds: bounds}
+	h.counts = make([]int, len(bounds))
+	return h
+}
+func startRequest(w http.ResponseWriter) *measuredWriter {
+	stats.Lock()
+	stats.inFlight++
+	stats.Unlock()
+	mw := &measuredWriter{ResponseWriter: w, start: time.Now(),
+		status: http.StatusOK}
+	return mw
+}
+func finishRequest(service string, mw *measuredWriter) {
+	d := time.Since(mw.start).Seconds()
+	stats.Lock()
+	defer stats.Unlock()
+	stats.inFlight--
+	stats.requests[requestKey{service, mw.status}]++
+	if stats.durations[service] == nil {
+		stats.durations[service] = newHistogram(durationBounds)
+		stats.sizes[service] = newHistogram(sizeBounds)
+	}
+	stats.durations[service].observe(d)
+	stats.sizes[service].observe(float64(mw.size))
+}
+func metrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	stats.Lock()
+	fmt.Fprintln(&b, "# HELP never_requests_total "+
+		"Requests by service and status code.")
+	fmt.Fprintln(&b, "# TYPE never_requests_total counter")
+	keys := []requestKey{}
+	for key := range stats.requests {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		if c := strings.Compare(a.service, b.service); c != 0 {
+			return c
+		}
+		return a.status - b.status
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "never_requests_total"+
+			"{service=%q,code=\"%d\"} %d\n",
+			key.service, key.status, stats.requests[key])
+	}
+	printHistograms(&b, "never_request_duration_seconds",
+		"Request durations in seconds.", stats.durations)
+	printHistograms(&b, "never_response_size_bytes",
+		"Response sizes in bytes.", stats.sizes)
+	fmt.Fprintln(&b, "# HELP never_requests_in_flight "+
+		"Requests currently being served.")
+	fmt.Fprintln(&b, "# TYPE never_requests_in_flight gauge")
+	fmt.Fprintf(&b, "never_requests_in_flight %d\n", stats.inFlight)
+	stats.Unlock()
+	fmt.Fprintln(&b, "# HELP never_errors_total "+
+		"Errors reported through util.Check, mostly database errors.")
+	fmt.Fprintln(&b, "# TYPE never_errors_total counter")
+	fmt.Fprintf(&b, "never_errors_total %d\n", util.NumErrors())
+	cache.Lock()
+	fmt.Fprintln(&b, "# HELP never_cache_hits_total Response cache hits.")
+	fmt.Fprintln(&b, "# TYPE never_cache_hits_total counter")
+	fmt.Fprintf(&b, "never_cache_hits_total %d\n", cache.hits)
+	fmt.Fprintln(&b, "# HELP never_cache_misses_total "+
+		"Response cache misses.")
+	fmt.Fprintln(&b, "# TYPE never_cache_misses_total counter")
+	fmt.Fprintf(&b, "never_cache_misses_total %d\n", cache.misses)
+	fmt.Fprintln(&b, "# HELP never_cache_entries "+
+		"Responses in the cache.")
+	fmt.Fprintln(&b, "# TYPE never_cache_entries gauge")
+	fmt.Fprintf(&b, "never_cache_entries %d\n", len(cache.entries))
+	fmt.Fprintln(&b, "# HELP never_cache_bytes Size of the cache in bytes.")
+	fmt.Fprintln(&b, "# TYPE never_cache_bytes gauge")
+	fmt.Fprintf(&b, "never_cache_bytes %d\n", cache.size)
+	cache.Unlock()
+	w.Header().Set("Content-Type",
+		"text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+func printHistograms(b *bytes.Buffer, name, help string,
+	hists map[string]*histogram) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+	services := []string{}
+	for service := range hists {
+		services = append(services, service)
+	}
+	slices.Sort(services)
+	for _, service := range services {
+		h := hists[service]
+		for i, bound := range h.bounds {
+			fmt.Fprintf(b, "%s_bucket{service=%q,le=\"%g\"} %d\n",
+				name, service, bound, h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{service=%q,le=\"+Inf\"} %d\n",
+			name, service, h.n)
+		fmt.Fprintf(b, "%s_sum{service=%q} %g\n",
+			name, service, h.sum)
+		fmt.Fprintf(b, "%s_count{service=%q} %d\n",
+			name, service, h.n)
+	}
+}
+func healthz(w http.ResponseWriter, r *http.Request) {
+	printJSON(w, r, http.StatusOK, Health{Status: "ok"})
+}
+func readyz(w http.ResponseWriter, r *http.Request) {
+	rd := Readiness{Status: "ready", Database: dbFile}
+	status := http.StatusOK
+	var err error
+	d := acquireDB()
+	rd.NumTaxa, err = checkDB(d)
+	d.users.Done()
+	if err == nil {
+		rd.Updated, err = databaseDate()
+	}
+	if err != nil {
+		rd.Status = "unavailable"
+		rd.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	printJSON(w, r, status, rd)
+}
+func checkDB(d *database) (int, error) {
+	n, err := countTaxa(d, readyTimeout)
+	if err == nil && n == 0 {
+		err = errors.New("database contains no taxa")
+	}
+	return n, err
+}
+func countTaxa(d *database,
+	timeout time.Duration) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	c := make(chan result, 1)
+	d.users.Add(1)
+	go func() {
+		defer d.users.Done()
+		n, err := d.NumTaxa()
+		c <- result{n, err}
+	}()
+	select {
+	case res := <-c:
+		return res.n, res.err
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("database didn't respond "+
+			"within %v", timeout)
+	}
+}
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.checkStamp()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry), true
+}
+func (c *responseCache) checkStamp() {
+	fi, err := os.Stat(dateFile)
+	if err != nil || fi.ModTime().Equal(c.stamp) {
+		return
+	}
+	c.reset()
+	c.stamp = fi.ModTime()
+}
+func (c *responseCache) reset() {
+	c.order = list.New()
+	c.entries = make(map[string]*list.Element)
+	c.size = 0
+}
+func (c *responseCache) clear() {
+	c.Lock()
+	c.reset()
+	c.Unlock()
+}
+func (c *responseCache) put(entry *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if len(entry.body) > c.capacity {
+		return
+	}
+	if e, ok := c.entries[entry.key]; ok {
+		c.remove(e)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += len(entry.body)
+	for c.size > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+func (c *responseCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.body)
+}
+func (c *cacheWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+func (c *cacheWriter) Write(b []byte) (int, error) {
+	if !c.overflow {
+		if c.body.Len()+len(b) > cache.capacity {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(b)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+func (c *cacheWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+func (c *cacheWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+func cached(name string, fn func(http.ResponseWriter,
+	*http.Request, *PageData)) func(http.ResponseWriter,
+	*http.Request, *PageData) {
+	return func(w http.ResponseWriter, r *http.Request,
+		p *PageData) {
+		if r.Method != http.MethodGet || cache.capacity == 0 ||
+			getFormat(r) == "ndjson" {
+			fn(w, r, p)
+			return
+		}
+		key := responseKey(name, r)
+		if entry, ok := cache.get(key); ok {
+			for k, v := range entry.header {
+				w.Header()[k] = v
+			}
+			w.Write(entry.body)
+			return
+		}
+		cw := &cacheWriter{ResponseWriter: w,
+			status: http.StatusOK}
+		fn(cw, r, p)
+		if cw.status == http.StatusOK && !cw.overflow {
+			header := http.Header{}
+			for _, k := range cachedHeaders {
+				if v := w.Header().Values(k); len(v) > 0 {
+					header[k] = v
+				}
+			}
+			cache.put(&cacheEntry{
+				key:    key,
+				header: header,
+				body:   cw.body.Bytes(),
+			})
+		}
+	}
+}
+func responseKey(name string, r *http.Request) string {
+	return name + " " + getFormat(r) + " " + r.URL.Query().Encode()
+}
+func getValidators(r *http.Request, name string) *validators {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+	date, err := os.ReadFile(dateFile)
+	if err != nil {
+		return nil
+	}
+	fi, err := os.Stat(dateFile)
+	if err != nil {
+		return nil
+	}
+	return &validators{mod: fi.ModTime(),
+		tag: entityTag(date, name, r)}
+}
+func (v *validators) set(h http.Header, tag string) {
+	h.Set("Last-Modified", v.mod.UTC().Format(http.TimeFormat))
+	h.Set("ETag", tag)
+	h.Set("Cache-Control", "public, no-cache")
+}
+func (v *validators) match(r *http.Request, tag string) string {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == v.tag || t == gzipTag(v.tag) {
+				return t
+			}
+			if t == "*" {
+				return tag
+			}
+		}
+		return ""
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || v.mod.Truncate(time.Second).After(ims) {
+		return ""
+	}
+	return tag
+}
+func (vw *validatingWriter) WriteHeader(status int) {
+	if !vw.wrote && vw.v != nil && status == http.StatusOK {
+		h := vw.Header()
+		tag := vw.v.tag
+		if h.Get("Content-Encoding") == "gzip" {
+			tag = gzipTag(tag)
+		}
+		if m := vw.v.match(vw.r, tag); m != "" {
+			h.Del("Content-Type")
+			h.Del("Content-Length")
+			h.Del("Content-Encoding")
+			tag = m
+			status = http.StatusNotModified
+			vw.unchanged = true
+		}
+		vw.v.set(h, tag)
+	}
+	vw.wrote = true
+	vw.ResponseWriter.WriteHeader(status)
+}
+func (vw *validatingWriter) Write(b []byte) (int, error) {
+	if !vw.wrote {
+		vw.WriteHeader(http.StatusOK)
+	}
+	if vw.unchanged {
+		return len(b), nil
+	}
+	return vw.ResponseWriter.Write(b)
+}
+func (vw *validatingWriter) Flush() {
+	if f, ok := vw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+func entityTag(date []byte, name string, r *http.Request) string {
+	h := sha256.New()
+	h.Write(date)
+	h.Write([]byte(responseKey(name, r)))
+	return fmt.Sprintf("\"%x\"", h.Sum(nil)[:16])
+}
+func newCompressWriter(w http.ResponseWriter,
+	r *http.Request) *compressWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	c := &compressWriter{ResponseWriter: w, status: http.StatusOK}
+	c.decided = !acceptsGzip(r)
+	return c
+}
+func acceptsGzip(r *http.Request) bool {
+	ae := r.Header.Get("Accept-Encoding")
+	for _, e := range strings.Split(ae, ",") {
+		fields := strings.Split(e, ";")
+		coding := strings.TrimSpace(fields[0])
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		accepted := true
+		for _, f := range fields[1:] {
+			q, ok := strings.CutPrefix(strings.TrimSpace(f), "q=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseFloat(q, 64)
+			accepted = err != nil || v > 0
+		}
+		if accepted {
+			return true
+		}
+	}
+	return false
+}
+func (c *compressWriter) WriteHeader(status int) {
+	if c.decided {
+		c.ResponseWriter.WriteHeader(status)
+	} else {
+		c.status = status
+	}
+}
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.decided {
+		if c.gz != nil {
+			return c.gz.Write(b)
+		}
+		return c.ResponseWriter.Write(b)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= minCompress {
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+func (c *compressWriter) decide(compress bool) error {
+	c.decided = true
+	h := c.Header()
+	if compress && h.Get("Content-Encoding") == "" {
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(c.buf))
+		}
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		c.gz = gzip.NewWriter(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	var err error
+	if c.gz != nil {
+		_, err = c.gz.Write(c.buf)
+	} else if len(c.buf) > 0 {
+		_, err = c.ResponseWriter.Write(c.buf)
+	}
+	c.buf = nil
+	return err
+}
+func gzipTag(tag string) string {
+	return strings.TrimSuffix(tag, "\"") + "-gzip\""
+}
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(len(c.buf) > 0)
+	}
+	if c.gz != nil {
+		c.gz.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+func (c *compressWriter) Close() {
+	if !c.decided {
+		c.decide(false)
+	}
+	if c.gz != nil {
+		c.gz.Close()
+	}
+}
+func getPagination(w http.ResponseWriter,
+	r *http.Request) (*Pagination, bool) {
+	q := r.URL.Query()
+	if q.Get("limit") == "" && q.Get("offset") == "" {
+		return nil, true
+	}
+	pg := new(Pagination)
+	for _, key := range []string{"limit", "offset"} {
+		v := q.Get(key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			util.WriteError(w, http.StatusBadRequest,
+				"malformed "+key, key, v)
+			return nil, false
+		}
+		if key == "limit" {
+			pg.Limit = n
+		} else {
+			pg.Offset = n
+		}
+	}
+	return pg, true
+}
+func paginate[T any](w http.ResponseWriter, r *http.Request,
+	pg *Pagination, items []T) []T {
+	if pg == nil {
+		return items
+	}
+	total := len(items)
+	start := min(pg.Offset, total)
+	end := total
+	if pg.Limit > 0 {
+		end = min(start+pg.Limit, total)
+	}
+	h := w.Header()
+	h.Set("X-Total-Count", strconv.Itoa(total))
+	h.Set("Access-Control-Expose-Headers", "X-Total-Count, Link")
+	if end < total {
+		next := *r.URL
+		q := next.Query()
+		q.Set("offset", strconv.Itoa(end))
+		next.RawQuery = q.Encode()
+		h.Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	return items[start:end]
+}
+func getFormat(r *http.Request) string {
+	format := r.URL.Query().Get("format")
+	if format != "" {
+		return format
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "text/tab-separated-values") {
+		return "tsv"
+	}
+	if strings.Contains(accept, "text/csv") {
+		return "csv"
+	}
+	return "json"
+}
+func printResult(w http.ResponseWriter, r *http.Request,
+	out any) {
+	format := getFormat(r)
+	switch format {
+	case "json":
+		printJSON(w, r, http.StatusOK, out)
+	case "tsv", "csv":
+		printTable(w, format, out)
+	default:
+		util.WriteError(w, http.StatusBadRequest,
+			"unknown format", "format", format)
+	}
+}
+func printJSON(w http.ResponseWriter, r *http.Request,
+	status int, out any) {
+	pretty, err := getPretty(r)
+	if err != nil {
+		util.WriteError(w, http.StatusBadRequest,
+			"malformed pretty", "pretty",
+			r.URL.Query().Get("pretty"))
+		return
+	}
+	util.WriteJSON(w, status, out, pretty)
+}
+func getPretty(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("pretty")
+	if v == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(v)
+}
+func (pw *prettyWriter) Indent() bool {
+	return pw.pretty
+}
+func (pw *prettyWriter) Flush() {
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+func (pw *prettyWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+func printTable(w http.ResponseWriter, format string, out any) {
+	table, ok := tabulate(out)
+	if !ok {
+		util.WriteError(w, http.StatusBadRequest,
+			"format not available for this result",
+			"format", format)
+		return
+	}
+	cw := csv.NewWriter(w)
+	if format == "tsv" {
+		cw.Comma = '\t'
+		w.Header().Set("Content-Type",
+			"text/tab-separated-values")
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+	}
+	err := cw.WriteAll(table)
 	util.Check(err)
-	fmt.Fprintf(w, "%s\n", string(b))
+}
+func table[T record](items []T) [][]string {
+	var t T
+	rows := [][]string{t.header()}
+	for _, item := range items {
+		rows = append(rows, item.records()...)
+	}
+	return rows
+}
+func tabulate(out any) ([][]string, bool) {
+	switch v := out.(type) {
+	case []Taxon:
+		return table(v), true
+	case []Accessions:
+		return table(v), true
+	case []Name:
+		return table(v), true
+	case []Rank:
+		return table(v), true
+	case []Taxid:
+		return table(v), true
+	case Taxid:
+		return table([]Taxid{v}), true
+	case []Child:
+		return table(v), true
+	case []Node:
+		return table(v), true
+	case []Level:
+		return table(v), true
+	case []GenomeCount:
+		return table(v), true
+	case []TaxonInfo:
+		return table(v), true
+	case Neighbors:
+		return table([]Neighbors{v}), true
+	case []Lineage:
+		return table(v), true
+	case Path:
+		return table([]Path{v}), true
+	case DistanceMatrix:
+		return table([]DistanceMatrix{v}), true
+	}
+	return nil, false
+}
+func (t Taxon) header() []string {
+	return []string{"taxid", "parent", "name", "common_name"}
+}
+func (t Taxon) records() [][]string {
+	r := []string{strconv.Itoa(t.Taxid), strconv.Itoa(t.Parent),
+		t.Name, t.CommonName}
+	return [][]string{r}
+}
+func (a Accessions) header() []string {
+	return []string{"taxid", "accession", "level"}
+}
+func (a Accessions) records() [][]string {
+	rs := [][]string{}
+	for _, acc := range a.Accs {
+		r := []string{strconv.Itoa(a.Taxid), acc.Accession,
+			acc.Level}
+		rs = append(rs, r)
+	}
+	return rs
+}
+func (n Name) header() []string {
+	return []string{"taxid", "name", "common_name"}
+}
+func (n Name) records() [][]string {
+	r := []string{strconv.Itoa(n.Taxid), n.Name, n.CommonName}
+	return [][]string{r}
+}
+func (r Rank) header() []string {
+	return []string{"taxid", "rank"}
+}
+func (r Rank) records() [][]string {
+	return [][]string{{strconv.Itoa(r.Taxid), r.Rank}}
+}
+func (t Taxid) header() []string {
+	return []string{"taxid"}
+}
+func (t Taxid) records() [][]string {
+	return [][]string{{strconv.Itoa(t.Taxid)}}
+}
+func (c Child) header() []string {
+	return []string{"taxid", "name", "common_name"}
+}
+func (c Child) records() [][]string {
+	r := []string{strconv.Itoa(c.Taxid), c.Name, c.CommonName}
+	return [][]string{r}
+}
+func (n Node) header() []string {
+	return []string{"taxid", "name", "common_name", "parent"}
+}
+func (n Node) records() [][]string {
+	r := []string{strconv.Itoa(n.Taxid), n.Name, n.CommonName,
+		strconv.Itoa(n.Parent)}
+	return [][]string{r}
+}
+func (l Level) header() []string {
+	return []string{"accession", "level"}
+}
+func (l Level) records() [][]string {
+	return [][]string{{l.Accession, l.Level}}
+}
+func (g GenomeCount) header() []string {
+	return []string{"level", "count"}
+}
+func (g GenomeCount) records() [][]string {
+	return [][]string{{g.Level, strconv.Itoa(g.Count)}}
+}
+func (t TaxonInfo) header() []string {
+	h := []string{"taxid", "parent", "is_leaf", "name",
+		"common_name", "rank"}
+	for _, prefix := range []string{"raw_", "rec_"} {
+		for _, level := range tdb.AssemblyLevels() {
+			level = strings.ReplaceAll(level, " ", "_")
+			h = append(h, prefix+level)
+		}
+	}
+	h = append(h, "images")
+	return h
+}
+func (t TaxonInfo) records() [][]string {
+	r := []string{strconv.Itoa(t.Taxid), strconv.Itoa(t.Parent),
+		strconv.FormatBool(t.IsLeaf), t.Name, t.CommonName,
+		t.Rank}
+	r = append(r, countColumns(t.RawCounts)...)
+	r = append(r, countColumns(t.RecCounts)...)
+	urls := []string{}
+	for _, image := range t.Images {
+		urls = append(urls, image.Url)
+	}
+	r = append(r, strings.Join(urls, ";"))
+	return [][]string{r}
+}
+func countColumns(counts []GenomeCount) []string {
+	columns := []string{}
+	for _, level := range tdb.AssemblyLevels() {
+		n := 0
+		for _, count := range counts {
+			if count.Level == level {
+				n = count.Count
+			}
+		}
+		columns = append(columns, strconv.Itoa(n))
+	}
+	return columns
+}
+func (n Neighbors) header() []string {
+	return []string{"mrca", "set", "taxid", "accession", "level"}
+}
+func (n Neighbors) records() [][]string {
+	rs := [][]string{}
+	sets := map[string][]Accessions{"target": n.Targets,
+		"neighbor": n.Neighbors}
+	for _, set := range []string{"target", "neighbor"} {
+		for _, accs := range sets[set] {
+			for _, r := range accs.records() {
+				r = append([]string{strconv.Itoa(n.Mrca),
+					set}, r...)
+				rs = append(rs, r)
+			}
+		}
+	}
+	return rs
+}
+func (l Lineage) header() []string {
+	return []string{"taxid", "ancestor", "name", "common_name",
+		"rank"}
+}
+func (l Lineage) records() [][]string {
+	rs := [][]string{}
+	for _, a := range l.Ancestors {
+		r := []string{strconv.Itoa(l.Taxid), strconv.Itoa(a.Taxid),
+			a.Name, a.CommonName, a.Rank}
+		rs = append(rs, r)
+	}
+	return rs
+}
+func (p Path) header() []string {
+	return append([]string{"leg"}, Taxon{}.header()...)
+}
+func (p Path) records() [][]string {
+	rs := [][]string{}
+	legs := []string{"up", "mrca", "down"}
+	nodes := [][]Taxon{p.Up, {p.Mrca}, p.Down}
+	for i, leg := range legs {
+		for _, t := range nodes[i] {
+			r := append([]string{leg}, t.records()[0]...)
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+func (m DistanceMatrix) header() []string {
+	return []string{"taxid_1", "taxid_2", "distance", "mrca",
+		"mrca_rank"}
+}
+func (m DistanceMatrix) records() [][]string {
+	rs := [][]string{}
+	for i, a := range m.Taxa {
+		for j := i + 1; j < len(m.Taxa); j++ {
+			r := []string{strconv.Itoa(a), strconv.Itoa(m.Taxa[j]),
+				strconv.Itoa(m.Distances[i][j]),
+				strconv.Itoa(m.Mrcas[i][j]), m.MrcaRanks[i][j]}
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+func waitForUsers(ctx context.Context) error {
+	left := make(chan struct{})
+	go func() {
+		reloadMutex.Lock()
+		curDB.Load().users.Wait()
+		close(left)
+	}()
+	select {
+	case <-left:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+func reloadDB() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	if _, err := os.Stat(dbFile); err != nil {
+		return err
+	}
+	d := &database{TaxonomyDB: tdb.OpenTaxonomyDB(dbFile)}
+	_, err := checkDB(d)
+	if err == nil {
+		_, err = databaseDate()
+	}
+	if err != nil {
+		go func() {
+			d.users.Wait()
+			d.Close()
+		}()
+		return err
+	}
+	dbMutex.Lock()
+	old := curDB.Swap(d)
+	dbMutex.Unlock()
+	old.users.Wait()
+	old.Close()
+	cache.clear()
+	return nil
 }
 func main() {
 	util.PrepLog("never")
@@ -595,6 +2808,8 @@ func main() {
 	flagK := flag.String("k", "", "private key")
 	flagD := flag.String("d", "neidb", "database")
 	flagU := flag.String("u", "updated.txt", "last updated")
+	flagG := flag.Duration("g", 30*time.Second, "grace period")
+	flagM := flag.Int("m", 256, "cache size in MB, 0 for no cache")
 	u := "never [flag]..."
 	p := "The program never is a web server " +
 		"providing a REST API for the Neighbors package."
@@ -607,7 +2822,8 @@ func main() {
 	}
 	host = *flagO
 	port = *flagP
-	neidb = tdb.OpenTaxonomyDB(*flagD)
+	dbFile = *flagD
+	curDB.Store(&database{TaxonomyDB: tdb.OpenTaxonomyDB(dbFile)})
 	date, err := os.ReadFile(*flagU)
 	util.Check(err)
 	tmpFields := bytes.Fields(date)
@@ -616,6 +2832,7 @@ func main() {
 			string(date))
 	}
 	dateFile = *flagU
+	cache.capacity = *flagM << 20
 	staticFiles := http.FileServer(http.Dir("static"))
 	http.Handle("/static/", http.StripPrefix("/static/",
 		staticFiles))
@@ -623,27 +2840,78 @@ func main() {
 	http.Handle("/vitax/", http.StripPrefix("/vitax/", vitaxFiles))
 	dataFiles := http.FileServer(http.Dir("data"))
 	http.Handle("/data/", http.StripPrefix("/data/", dataFiles))
-	http.HandleFunc("/", makeHandler(index))
-	http.HandleFunc("/taxi/", makeHandler(taxi))
-	http.HandleFunc("/accessions/", makeHandler(accessions))
-	http.HandleFunc("/names/", makeHandler(names))
-	http.HandleFunc("/ranks/", makeHandler(ranks))
-	http.HandleFunc("/parent/", makeHandler(parent))
-	http.HandleFunc("/children/", makeHandler(children))
-	http.HandleFunc("/subtree/", makeHandler(subtree))
-	http.HandleFunc("/taxids/", makeHandler(taxids))
-	http.HandleFunc("/mrca/", makeHandler(mrca))
-	http.HandleFunc("/levels/", makeHandler(levels))
+	http.HandleFunc("/", makeHandler("index",
+		cached("index", index)))
+	http.HandleFunc("/taxi/", makeHandler("taxi", taxi))
+	http.HandleFunc("/neighbors/", makeHandler("neighbors", neighbors))
+	http.HandleFunc("/accessions/", makeHandler("accessions",
+		cached("accessions", accessions)))
+	http.HandleFunc("/names/", makeHandler("names", names))
+	http.HandleFunc("/ranks/", makeHandler("ranks", ranks))
+	http.HandleFunc("/parent/", makeHandler("parent", parent))
+	http.HandleFunc("/children/", makeHandler("children", children))
+	http.HandleFunc("/subtree/", makeHandler("subtree",
+		cached("subtree", subtree)))
+	http.HandleFunc("/newick/", makeHandler("newick", newick))
+	http.HandleFunc("/descendants_at_rank/",
+		makeHandler("descendants_at_rank",
+			cached("descendants_at_rank", descendants_at_rank)))
+	http.HandleFunc("/taxids/", makeHandler("taxids", taxids))
+	http.HandleFunc("/mrca/", makeHandler("mrca", mrca))
+	http.HandleFunc("/levels/", makeHandler("levels", levels))
 	http.HandleFunc("/num_genomes/",
-		makeHandler(num_genomes))
-	http.HandleFunc("/num_genomes_rec/", makeHandler(num_genomes_rec))
-	http.HandleFunc("/taxa_info/", makeHandler(taxa_info))
-	http.HandleFunc("/path/", makeHandler(path))
+		makeHandler("num_genomes", num_genomes))
+	http.HandleFunc("/num_genomes_rec/", makeHandler("num_genomes_rec",
+		cached("num_genomes_rec", num_genomes_rec)))
+	http.HandleFunc("/taxa_info/", makeHandler("taxa_info", taxa_info))
+	http.HandleFunc("/path/", makeHandler("path", path))
+	http.HandleFunc("/distance_matrix/", makeHandler("distance_matrix",
+		distance_matrix))
+	http.HandleFunc("/tree/", makeHandler("tree", tree))
+	http.HandleFunc("/lineage/", makeHandler("lineage", lineage))
+	http.HandleFunc("/batch/", makeHandler("batch", batch))
+	http.HandleFunc("/metrics", metrics)
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
 	host := *flagO + ":" + *flagP
+	server := &http.Server{Addr: host}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := reloadDB(); err != nil {
+				log.Printf("reload: %v", err)
+			} else {
+				log.Printf("reloaded %s", dbFile)
+			}
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		s := <-sig
+		log.Printf("received %v, shutting down", s)
+		ctx, cancel := context.WithTimeout(context.Background(),
+			*flagG)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err == nil {
+			err = waitForUsers(ctx)
+		}
+		if err != nil {
+			log.Printf("shutdown: %v, cutting off running requests", err)
+		}
+		curDB.Load().Close()
+		close(done)
+	}()
 	if *flagC != "" && *flagK != "" {
-		log.Fatal(http.ListenAndServeTLS(host, *flagC,
-			*flagK, nil))
+		err = server.ListenAndServeTLS(*flagC, *flagK)
 	} else {
-		log.Fatal(http.ListenAndServe(host, nil))
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
+	<-done
 }
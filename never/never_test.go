@@ -7,6 +7,11 @@ import (
 	"os/exec"
 	"strconv"
 	"testing"
+
+	"errors"
+	"github.com/evolbioinf/never/util"
+	"net/http"
+	"net/http/httptest"
 )
 
 func TestNever(t *testing.T) {
@@ -70,6 +75,139 @@ func TestNever(t *testing.T) {
 	u = fmt.Sprintf(tmpl, url, "levels", query)
 	test = exec.Command(prog, u)
 	tests = append(tests, test)
+	query = "t=765698"
+	u = fmt.Sprintf(tmpl, url, "neighbors", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=abc"
+	u = fmt.Sprintf(tmpl, url, "names", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=99999999"
+	u = fmt.Sprintf(tmpl, url, "names", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606,abc,99999999&envelope=1"
+	u = fmt.Sprintf(tmpl, url, "names", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&label=both"
+	u = fmt.Sprintf(tmpl, url, "newick", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606,9605&format=tsv"
+	u = fmt.Sprintf(tmpl, url, "names", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606,9605&format=csv"
+	u = fmt.Sprintf(tmpl, url, "names", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	ops := `[{"service": "names", "params": {"t": [9606, 9605]}}, ` +
+		`{"service": "parent", "params": {"t": 562}}]`
+	test = exec.Command("curl", "-s", "-d", ops, url+"/batch/")
+	tests = append(tests, test)
+	query = "t=278148,602633&format=ndjson"
+	u = fmt.Sprintf(tmpl, url, "accessions", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&format=ndjson"
+	u = fmt.Sprintf(tmpl, url, "subtree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	test = exec.Command(prog, url+"/healthz")
+	tests = append(tests, test)
+	ims := "If-Modified-Since: Fri, 01 Jan 2100 00:00:00 GMT"
+	u = fmt.Sprintf(tmpl, url, "names", "t=9606")
+	test = exec.Command("curl", "-s", "-o", "/dev/null",
+		"-w", "%{http_code}\n", "-H", ims, u)
+	tests = append(tests, test)
+	u = fmt.Sprintf(tmpl, url, "names", "t=99999999")
+	test = exec.Command("curl", "-s", "-H", ims, u)
+	tests = append(tests, test)
+	query = "t=9606&pretty=0"
+	u = fmt.Sprintf(tmpl, url, "children", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=abc&pretty=0"
+	u = fmt.Sprintf(tmpl, url, "names", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&limit=1&offset=1"
+	u = fmt.Sprintf(tmpl, url, "subtree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	test = exec.Command("curl", "-s", "-o", "/dev/null", "-w",
+		"%header{x-total-count}\n%header{link}\n", u)
+	tests = append(tests, test)
+	query = "t=9606&depth=0"
+	u = fmt.Sprintf(tmpl, url, "subtree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&stop_rank=species"
+	u = fmt.Sprintf(tmpl, url, "subtree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&depth=-1"
+	u = fmt.Sprintf(tmpl, url, "subtree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&rank=subspecies"
+	u = fmt.Sprintf(tmpl, url, "children", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&rank=subspecies&genomes=1"
+	u = fmt.Sprintf(tmpl, url, "descendants_at_rank", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=278148,602633&level=complete"
+	u = fmt.Sprintf(tmpl, url, "accessions", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=278148,602633&best=1"
+	u = fmt.Sprintf(tmpl, url, "accessions", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=278148,602633&per_taxon=x"
+	u = fmt.Sprintf(tmpl, url, "accessions", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=278148&recursive=0"
+	u = fmt.Sprintf(tmpl, url, "accessions", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=278148&max_depth=1"
+	u = fmt.Sprintf(tmpl, url, "accessions", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=1&ranked=1"
+	u = fmt.Sprintf(tmpl, url, "lineage", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606,9605,40674"
+	u = fmt.Sprintf(tmpl, url, "distance_matrix", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606,9605,40674&format=phylip"
+	u = fmt.Sprintf(tmpl, url, "distance_matrix", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606,9605,40674&collapse=1"
+	u = fmt.Sprintf(tmpl, url, "tree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606,9605,40674&collapse=1&format=newick"
+	u = fmt.Sprintf(tmpl, url, "tree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&format=nested"
+	u = fmt.Sprintf(tmpl, url, "subtree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
+	query = "t=9606&format=nested&ranked=1"
+	u = fmt.Sprintf(tmpl, url, "subtree", query)
+	test = exec.Command(prog, u)
+	tests = append(tests, test)
 	for i, test := range tests {
 		get, err := test.Output()
 		if err != nil {
@@ -85,3 +223,17 @@ func TestNever(t *testing.T) {
 		}
 	}
 }
+func TestCheckHTTP(t *testing.T) {
+	w := httptest.NewRecorder()
+	if !util.CheckHTTP(w, errors.New("database is locked")) {
+		t.Error("error not reported")
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("get status %d, want %d", w.Code,
+			http.StatusInternalServerError)
+	}
+	want := "{\n    \"error\": \"database is locked\"\n}\n"
+	if get := w.Body.String(); get != want {
+		t.Errorf("get:\n%s\nwant:\n%s\n", get, want)
+	}
+}
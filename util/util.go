@@ -2,31 +2,89 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/evolbioinf/clio"
 	"log"
 	"net/http"
 	"os"
+	"sync/atomic"
 )
 
+// Indenter is implemented by response writers that know whether the client wants its JSON indented.
+type Indenter interface {
+	Indent() bool
+}
+
+// HTTPError holds the error message written by WriteError together with the query parameter and value that caused it.
+type HTTPError struct {
+	Error string `json:"error"`
+	Param string `json:"param,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+var numErrors atomic.Int64
 var program string
 var date, version string
 
 // Check takes an error as argument. If the error isn't nil, it is printed to the standard error stream.
 func Check(err error) {
 	if err != nil {
+		numErrors.Add(1)
 		fmt.Fprintf(os.Stderr, "ERROR[never]: %s\n", err)
 	}
 }
 
-// CheckHTTP takes as arguments a HTTP respose writer and an eror. If the error is not nil, it is printed, unless it corresponds to one of the two standard messages that crop up in never, in which case the error is ignored.
-func CheckHTTP(w http.ResponseWriter, err error) {
+// NumErrors returns the number of errors reported through Check so far.
+func NumErrors() int64 {
+	return numErrors.Load()
+}
+
+// CheckHTTP takes as arguments a HTTP respose writer and an eror. If the error is not nil, it is printed and written to the response as an internal server error, unless it corresponds to one of the two standard messages that crop up in never, in which case the error is ignored. CheckHTTP returns true if it wrote an error.
+func CheckHTTP(w http.ResponseWriter, err error) bool {
 	m1 := "sql: Rows closed"
 	m2 := "Empty ID list in tdb.MRCA"
 	if err != nil && err.Error() != m1 &&
 		err.Error() != m2 {
-		http.Error(w, err.Error(),
-			http.StatusInternalServerError)
+		Check(err)
+		WriteError(w, http.StatusInternalServerError,
+			err.Error(), "", "")
+		return true
+	}
+	return false
+}
+
+// WriteError takes as arguments a HTTP response writer, a status code, an error message, and the name and value of the offending query parameter. It writes the error as a JSON object with the status code.
+func WriteError(w http.ResponseWriter, status int,
+	msg, param, value string) {
+	e := HTTPError{Error: msg, Param: param, Value: value}
+	WriteJSON(w, status, e, Indent(w))
+}
+
+// WriteJSON takes as arguments a HTTP response writer, a status code, a value, and whether to indent. It writes the value as JSON with the status code.
+func WriteJSON(w http.ResponseWriter, status int, v any,
+	indent bool) {
+	enc := json.NewEncoder(w)
+	if indent {
+		enc.SetIndent("", "    ")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := enc.Encode(v)
+	Check(err)
+}
+
+// Indent takes as argument a HTTP response writer and returns whether JSON written to it should be indented.
+func Indent(w http.ResponseWriter) bool {
+	for {
+		if in, ok := w.(Indenter); ok {
+			return in.Indent()
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return true
+		}
+		w = u.Unwrap()
 	}
 }
 